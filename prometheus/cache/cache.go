@@ -17,8 +17,10 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,12 +30,18 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus/internal"
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var _ prometheus.TransactionalGatherer = &CachedTGatherer{}
 
 var separatorByteSlice = []byte{model.SeparatorByte} // For convenient use with xxhash.
 
+// exemplarReservedLabelPrefix mirrors the main registry's unexported reservedLabelPrefix: label
+// names starting with it are reserved and rejected on regular labels, and Exemplar.isValid
+// applies the same rule to exemplar labels.
+const exemplarReservedLabelPrefix = "__"
+
 // CachedTGatherer is a transactional gatherer that allows maintaining a set of metrics which
 // change less frequently than scrape time, yet label values and values change over time.
 //
@@ -45,13 +53,28 @@ var separatorByteSlice = []byte{model.SeparatorByte} // For convenient use with
 type CachedTGatherer struct {
 	metrics            map[uint64]*dto.Metric
 	metricFamilyByName map[string]*dto.MetricFamily
-	mMu                sync.RWMutex
+	// metricsByFamily indexes the hashes of metrics currently cached under each FQName, so a
+	// scoped reset (UpdateFamilies) can find exactly the entries to drop without scanning the
+	// whole cache.
+	metricsByFamily map[string]map[uint64]struct{}
+
+	// version increments on every Update/UpdateFamilies call. metricVersions and removals let
+	// DiffSince compute an exact delta since a previous Snapshot without re-serializing the
+	// whole cache; see snapshot.go.
+	version            uint64
+	metricVersions     map[uint64]metricVersion
+	removals           []removedMetric
+	evictedUpToVersion uint64
+
+	mMu sync.RWMutex
 }
 
 func NewCachedTGatherer() *CachedTGatherer {
 	return &CachedTGatherer{
 		metrics:            make(map[uint64]*dto.Metric),
 		metricFamilyByName: map[string]*dto.MetricFamily{},
+		metricsByFamily:    map[string]map[uint64]struct{}{},
+		metricVersions:     map[uint64]metricVersion{},
 	}
 }
 
@@ -107,10 +130,199 @@ type Insert struct {
 	ValueType prometheus.ValueType
 	Value     float64
 
+	// Histogram, if non-nil, turns this Insert into a histogram sample; Value and ValueType
+	// are then ignored.
+	Histogram *HistogramInsert
+	// Summary, if non-nil, turns this Insert into a summary sample; Value and ValueType are
+	// then ignored.
+	Summary *SummaryInsert
+
+	// Exemplar is optional and only applies when ValueType is prometheus.CounterValue.
+	Exemplar *Exemplar
+
 	// Timestamp is optional. Pass nil for no explicit timestamp.
 	Timestamp *time.Time
 }
 
+// isValid validates the Key as well as any exemplars carried by this Insert.
+func (in *Insert) isValid() error {
+	if err := in.Key.isValid(); err != nil {
+		return err
+	}
+	if err := in.Exemplar.isValid(); err != nil {
+		return err
+	}
+	if in.Histogram != nil {
+		for i := range in.Histogram.Buckets {
+			if err := in.Histogram.Buckets[i].Exemplar.isValid(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Exemplar is an optional OpenMetrics exemplar to attach to a counter sample or a histogram
+// bucket.
+type Exemplar struct {
+	Labels prometheus.Labels
+	Value  float64
+
+	// Timestamp is optional. Pass nil for no explicit timestamp.
+	Timestamp *time.Time
+}
+
+// isValid reports whether e respects the same constraints the main registry enforces on
+// exemplars (see newExemplar in prometheus/value.go): label names must be valid, non-reserved
+// label names, label values must be valid UTF-8, and the combined rune count across names and
+// values must not exceed prometheus.ExemplarMaxRunes. A nil Exemplar is always valid.
+func (e *Exemplar) isValid() error {
+	if e == nil {
+		return nil
+	}
+
+	var runes int
+	for name, value := range e.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, exemplarReservedLabelPrefix) {
+			return fmt.Errorf("exemplar label name %q is invalid", name)
+		}
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("exemplar label value %q is not valid UTF-8", value)
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return fmt.Errorf("exemplar labels have %d UTF-8 characters, exceeding the limit of %d", runes, prometheus.ExemplarMaxRunes)
+	}
+	return nil
+}
+
+// toDTO writes e into dst, reusing dst's backing Label slice when possible. A nil Exemplar
+// returns a nil *dto.Exemplar, clearing any exemplar previously cached on the metric.
+func (e *Exemplar) toDTO(dst *dto.Exemplar) *dto.Exemplar {
+	if e == nil {
+		return nil
+	}
+	if dst == nil {
+		dst = &dto.Exemplar{}
+	}
+
+	dst.Label = dst.Label[:0]
+	for name, value := range e.Labels {
+		dst.Label = append(dst.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Sort(internal.LabelPairSorter(dst.Label))
+	dst.Value = &e.Value
+
+	dst.Timestamp = nil
+	if e.Timestamp != nil {
+		dst.Timestamp = timestamppb.New(*e.Timestamp)
+	}
+	return dst
+}
+
+// dtoType returns the metric family type this insert represents.
+func (in *Insert) dtoType() *dto.MetricType {
+	switch {
+	case in.Histogram != nil:
+		return dto.MetricType_HISTOGRAM.Enum()
+	case in.Summary != nil:
+		return dto.MetricType_SUMMARY.Enum()
+	default:
+		return in.ValueType.ToDTO()
+	}
+}
+
+// HistogramInsert carries the histogram-specific fields of an Insert. Set it on Insert.Histogram
+// to cache a histogram sample instead of a single value.
+type HistogramInsert struct {
+	SampleCount uint64
+	SampleSum   float64
+
+	// Buckets holds the cumulative, classic histogram buckets for this sample. It does not
+	// need to be sorted by UpperBound; Update sorts it before storing.
+	Buckets []BucketInsert
+
+	// NativeHistogram* fields are optional and populate the corresponding sparse,
+	// exponential-bucket fields of dto.Histogram. Leave them at their zero value for a
+	// classic (fixed-bucket) histogram.
+	NativeHistogramSchema        *int32
+	NativeHistogramZeroThreshold *float64
+	NativeHistogramZeroCount     *uint64
+	NativeHistogramPositiveSpans []*dto.BucketSpan
+	NativeHistogramPositiveDelta []int64
+	NativeHistogramNegativeSpans []*dto.BucketSpan
+	NativeHistogramNegativeDelta []int64
+}
+
+// BucketInsert is a single classic histogram bucket to set in cache.
+type BucketInsert struct {
+	UpperBound      float64
+	CumulativeCount uint64
+
+	// Exemplar is optional.
+	Exemplar *Exemplar
+}
+
+// SummaryInsert carries the summary-specific fields of an Insert. Set it on Insert.Summary to
+// cache a summary sample instead of a single value.
+type SummaryInsert struct {
+	SampleCount uint64
+	SampleSum   float64
+
+	// Quantiles does not need to be sorted by Quantile; Update sorts it before storing.
+	Quantiles []Quantile
+}
+
+// Quantile is a single summary quantile to set in cache.
+type Quantile struct {
+	Quantile float64
+	Value    float64
+}
+
+// setBuckets sorts buckets by upper bound and writes them into dst, reusing dst's backing array
+// (and its *dto.Bucket elements) when possible to avoid allocations on refresh.
+func setBuckets(dst []*dto.Bucket, buckets []BucketInsert) []*dto.Bucket {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].UpperBound < buckets[j].UpperBound })
+
+	full := dst[:cap(dst)]
+	dst = dst[:0]
+	for i := range buckets {
+		var b *dto.Bucket
+		if i < len(full) && full[i] != nil {
+			b = full[i]
+		} else {
+			b = &dto.Bucket{}
+		}
+		b.UpperBound = &buckets[i].UpperBound
+		b.CumulativeCount = &buckets[i].CumulativeCount
+		b.Exemplar = buckets[i].Exemplar.toDTO(b.Exemplar)
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+// setQuantiles sorts quantiles and writes them into dst, reusing dst's backing array (and its
+// *dto.Quantile elements) when possible to avoid allocations on refresh.
+func setQuantiles(dst []*dto.Quantile, quantiles []Quantile) []*dto.Quantile {
+	sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].Quantile < quantiles[j].Quantile })
+
+	full := dst[:cap(dst)]
+	dst = dst[:0]
+	for i := range quantiles {
+		var q *dto.Quantile
+		if i < len(full) && full[i] != nil {
+			q = full[i]
+		} else {
+			q = &dto.Quantile{}
+		}
+		q.Quantile = &quantiles[i].Quantile
+		q.Value = &quantiles[i].Value
+		dst = append(dst, q)
+	}
+	return dst
+}
+
 // Update goes through inserts and deletions and updates current cache in concurrency safe manner.
 // If reset is set to true, all inserts and deletions are working on empty cache. In such case
 // this implementation tries to reuse memory from existing cached item when possible.
@@ -123,11 +335,74 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 	c.mMu.Lock()
 	defer c.mMu.Unlock()
 
+	return c.update(reset, nil, inserts, deletions)
+}
+
+// UpdateFamilies behaves like Update(false, inserts, deletions), except the reset is scoped to
+// families: any metric currently cached under one of families that is not re-inserted by inserts
+// is dropped, while families outside of families are left completely untouched. Inserts and
+// deletions for families outside of families are still applied incrementally, exactly as
+// Update(false, ...) would.
+//
+// This allows multiple independent producers to share one gatherer, each refreshing only the
+// families it owns, without coordinating a global reset.
+func (c *CachedTGatherer) UpdateFamilies(families []string, inserts []Insert, deletions []Key) error {
+	c.mMu.Lock()
+	defer c.mMu.Unlock()
+
+	resetFamilies := make(map[string]struct{}, len(families))
+	for _, fqName := range families {
+		resetFamilies[fqName] = struct{}{}
+	}
+	return c.update(false, resetFamilies, inserts, deletions)
+}
+
+// update is the shared implementation behind Update and UpdateFamilies; callers must hold mMu.
+// resetFamilies is nil for a plain Update call; for UpdateFamilies it holds the families whose
+// reset is scoped, so that a metric re-inserted by inserts is reused in place (same *dto.Metric,
+// same metricVersion.created) rather than treated as newly added.
+func (c *CachedTGatherer) update(reset bool, resetFamilies map[string]struct{}, inserts []Insert, deletions []Key) error {
+	version := c.version + 1
+
 	currMetrics := c.metrics
 	currMetricFamilies := c.metricFamilyByName
+	currMetricsByFamily := c.metricsByFamily
+	currMetricVersions := c.metricVersions
 	if reset {
 		currMetrics = make(map[uint64]*dto.Metric, len(c.metrics))
 		currMetricFamilies = make(map[string]*dto.MetricFamily, len(c.metricFamilyByName))
+		currMetricsByFamily = make(map[string]map[uint64]struct{}, len(c.metricsByFamily))
+		currMetricVersions = make(map[uint64]metricVersion, len(c.metricVersions))
+	} else if len(resetFamilies) > 0 {
+		// Same idea as a full reset, but scoped: start from a copy of the current cache, then
+		// drop only the entries that live under resetFamilies. Everything else carries over
+		// untouched, and entries under resetFamilies that inserts re-adds below still resolve
+		// through the c.metrics/c.metricVersions lookups further down, so they keep their
+		// existing *dto.Metric and metricVersion.created instead of being reallocated.
+		currMetrics = make(map[uint64]*dto.Metric, len(c.metrics))
+		for hSum, m := range c.metrics {
+			currMetrics[hSum] = m
+		}
+		currMetricVersions = make(map[uint64]metricVersion, len(c.metricVersions))
+		for hSum, mv := range c.metricVersions {
+			currMetricVersions[hSum] = mv
+		}
+		currMetricFamilies = make(map[string]*dto.MetricFamily, len(c.metricFamilyByName))
+		for fqName, mf := range c.metricFamilyByName {
+			currMetricFamilies[fqName] = mf
+		}
+		currMetricsByFamily = make(map[string]map[uint64]struct{}, len(c.metricsByFamily))
+		for fqName, hashes := range c.metricsByFamily {
+			currMetricsByFamily[fqName] = hashes
+		}
+		for fqName := range resetFamilies {
+			for hSum := range c.metricsByFamily[fqName] {
+				delete(currMetrics, hSum)
+				delete(currMetricVersions, hSum)
+			}
+			delete(currMetricFamilies, fqName)
+			delete(currMetricsByFamily, fqName)
+		}
 	}
 
 	errs := prometheus.MultiError{}
@@ -138,16 +413,19 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 			continue
 		}
 
+		_, resetThisFamily := resetFamilies[inserts[i].FQName]
+		resetThis := reset || resetThisFamily
+
 		// Update metric family.
 		mf, ok := c.metricFamilyByName[inserts[i].FQName]
 		if !ok {
 			mf = &dto.MetricFamily{}
 			mf.Name = &inserts[i].FQName
-		} else if reset {
+		} else if resetThis {
 			// Reset metric slice, since we want to start from scratch.
 			mf.Metric = mf.Metric[:0]
 		}
-		mf.Type = inserts[i].ValueType.ToDTO()
+		mf.Type = inserts[i].dtoType()
 		mf.Help = &inserts[i].Help
 
 		currMetricFamilies[inserts[i].FQName] = mf
@@ -166,36 +444,77 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 			sort.Sort(internal.LabelPairSorter(m.Label))
 		}
 
-		switch inserts[i].ValueType {
-		case prometheus.CounterValue:
-			v := m.Counter
+		switch {
+		case inserts[i].Histogram != nil:
+			h := inserts[i].Histogram
+			v := m.Histogram
 			if v == nil {
-				v = &dto.Counter{}
+				v = &dto.Histogram{}
 			}
-			v.Value = &inserts[i].Value
-			m.Counter = v
-			m.Gauge = nil
-			m.Untyped = nil
-		case prometheus.GaugeValue:
-			v := m.Gauge
-			if v == nil {
-				v = &dto.Gauge{}
-			}
-			v.Value = &inserts[i].Value
+			v.SampleCount = &h.SampleCount
+			v.SampleSum = &h.SampleSum
+			v.Bucket = setBuckets(v.Bucket, h.Buckets)
+			v.Schema = h.NativeHistogramSchema
+			v.ZeroThreshold = h.NativeHistogramZeroThreshold
+			v.ZeroCount = h.NativeHistogramZeroCount
+			v.PositiveSpan = h.NativeHistogramPositiveSpans
+			v.PositiveDelta = h.NativeHistogramPositiveDelta
+			v.NegativeSpan = h.NativeHistogramNegativeSpans
+			v.NegativeDelta = h.NativeHistogramNegativeDelta
+			m.Histogram = v
 			m.Counter = nil
-			m.Gauge = v
+			m.Gauge = nil
 			m.Untyped = nil
-		case prometheus.UntypedValue:
-			v := m.Untyped
+			m.Summary = nil
+		case inserts[i].Summary != nil:
+			s := inserts[i].Summary
+			v := m.Summary
 			if v == nil {
-				v = &dto.Untyped{}
+				v = &dto.Summary{}
 			}
-			v.Value = &inserts[i].Value
+			v.SampleCount = &s.SampleCount
+			v.SampleSum = &s.SampleSum
+			v.Quantile = setQuantiles(v.Quantile, s.Quantiles)
+			m.Summary = v
 			m.Counter = nil
 			m.Gauge = nil
-			m.Untyped = v
+			m.Untyped = nil
+			m.Histogram = nil
 		default:
-			return fmt.Errorf("unsupported value type %v", inserts[i].ValueType)
+			switch inserts[i].ValueType {
+			case prometheus.CounterValue:
+				v := m.Counter
+				if v == nil {
+					v = &dto.Counter{}
+				}
+				v.Value = &inserts[i].Value
+				v.Exemplar = inserts[i].Exemplar.toDTO(v.Exemplar)
+				m.Counter = v
+				m.Gauge = nil
+				m.Untyped = nil
+			case prometheus.GaugeValue:
+				v := m.Gauge
+				if v == nil {
+					v = &dto.Gauge{}
+				}
+				v.Value = &inserts[i].Value
+				m.Counter = nil
+				m.Gauge = v
+				m.Untyped = nil
+			case prometheus.UntypedValue:
+				v := m.Untyped
+				if v == nil {
+					v = &dto.Untyped{}
+				}
+				v.Value = &inserts[i].Value
+				m.Counter = nil
+				m.Gauge = nil
+				m.Untyped = v
+			default:
+				return fmt.Errorf("unsupported value type %v", inserts[i].ValueType)
+			}
+			m.Histogram = nil
+			m.Summary = nil
 		}
 
 		m.TimestampMs = nil
@@ -204,7 +523,20 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 		}
 		currMetrics[hSum] = m
 
-		if !reset && ok {
+		byFamily, ok2 := currMetricsByFamily[inserts[i].FQName]
+		if !ok2 {
+			byFamily = map[uint64]struct{}{}
+			currMetricsByFamily[inserts[i].FQName] = byFamily
+		}
+		byFamily[hSum] = struct{}{}
+
+		mv := metricVersion{created: version, updated: version}
+		if ok {
+			mv.created = c.metricVersions[hSum].created
+		}
+		currMetricVersions[hSum] = mv
+
+		if !resetThis && ok {
 			// If we did update without reset and we found metric in previous
 			// map, we know metric pointer exists in metric family map, so just continue.
 			continue
@@ -226,6 +558,9 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 			continue
 		}
 		delete(currMetrics, hSum)
+		delete(currMetricsByFamily[del.FQName], hSum)
+		delete(currMetricVersions, hSum)
+		c.recordRemoval(del, version)
 
 		mf, ok := currMetricFamilies[del.FQName]
 		if !ok {
@@ -249,13 +584,45 @@ func (c *CachedTGatherer) Update(reset bool, inserts []Insert, deletions []Key)
 
 		if len(mf.Metric) == 1 {
 			delete(currMetricFamilies, del.FQName)
+			delete(currMetricsByFamily, del.FQName)
 			continue
 		}
 
 		mf.Metric = append(mf.Metric[:toDel], mf.Metric[toDel+1:]...)
 	}
 
+	if reset {
+		// Anything still in the old, pre-reset cache that wasn't re-inserted above was
+		// implicitly dropped by the reset; record it as a removal too, so DiffSince sees it.
+		for fqName, hashes := range c.metricsByFamily {
+			for hSum := range hashes {
+				if _, stillCached := currMetrics[hSum]; stillCached {
+					continue
+				}
+				if m, ok := c.metrics[hSum]; ok {
+					c.recordRemoval(keyFromLabelPairs(fqName, m.Label), version)
+				}
+			}
+		}
+	} else {
+		// Same as above, but scoped to resetFamilies: only metrics dropped by the scoped
+		// reset and not re-inserted above count as removed.
+		for fqName := range resetFamilies {
+			for hSum := range c.metricsByFamily[fqName] {
+				if _, stillCached := currMetrics[hSum]; stillCached {
+					continue
+				}
+				if m, ok := c.metrics[hSum]; ok {
+					c.recordRemoval(keyFromLabelPairs(fqName, m.Label), version)
+				}
+			}
+		}
+	}
+
 	c.metrics = currMetrics
 	c.metricFamilyByName = currMetricFamilies
+	c.metricsByFamily = currMetricsByFamily
+	c.metricVersions = currMetricVersions
+	c.version = version
 	return errs.MaybeUnwrap()
 }
@@ -0,0 +1,90 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExemplar_IsValid(t *testing.T) {
+	var nilExemplar *Exemplar
+	if err := nilExemplar.isValid(); err != nil {
+		t.Errorf("nil Exemplar should always be valid, got %v", err)
+	}
+
+	ok := &Exemplar{Labels: prometheus.Labels{"trace_id": "abc"}}
+	if err := ok.isValid(); err != nil {
+		t.Errorf("expected exemplar within the rune limit to be valid, got %v", err)
+	}
+
+	tooLong := &Exemplar{Labels: prometheus.Labels{"trace_id": strings.Repeat("a", prometheus.ExemplarMaxRunes+1)}}
+	if err := tooLong.isValid(); err == nil {
+		t.Error("expected exemplar exceeding prometheus.ExemplarMaxRunes to be invalid, got nil error")
+	}
+
+	badName := &Exemplar{Labels: prometheus.Labels{"1bad-name": "abc"}}
+	if err := badName.isValid(); err == nil {
+		t.Error("expected exemplar with an invalid label name to be invalid, got nil error")
+	}
+
+	reservedName := &Exemplar{Labels: prometheus.Labels{"__reserved": "abc"}}
+	if err := reservedName.isValid(); err == nil {
+		t.Error("expected exemplar with a reserved '__' label name to be invalid, got nil error")
+	}
+
+	invalidUTF8 := &Exemplar{Labels: prometheus.Labels{"trace_id": "\xff\xfe invalid utf8"}}
+	if err := invalidUTF8.isValid(); err == nil {
+		t.Error("expected exemplar with a non-UTF-8 label value to be invalid, got nil error")
+	}
+}
+
+func TestUpdate_CounterExemplar(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	if err := c.Update(false, []Insert{{
+		Key:       key,
+		Help:      "help",
+		ValueType: prometheus.CounterValue,
+		Value:     1,
+		Exemplar:  &Exemplar{Labels: prometheus.Labels{"trace_id": "abc"}, Value: 1},
+	}}, nil); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	m := c.metrics[key.hash()]
+	ex := m.GetCounter().GetExemplar()
+	if ex == nil {
+		t.Fatal("expected an exemplar on the counter, got nil")
+	}
+	if got := ex.GetValue(); got != 1 {
+		t.Errorf("got exemplar value %v, want 1", got)
+	}
+
+	// A later Update with no exemplar should clear the one that was cached.
+	if err := c.Update(false, []Insert{{
+		Key:       key,
+		Help:      "help",
+		ValueType: prometheus.CounterValue,
+		Value:     2,
+	}}, nil); err != nil {
+		t.Fatalf("second Update: %v", err)
+	}
+	if got := m.GetCounter().GetExemplar(); got != nil {
+		t.Errorf("expected exemplar to be cleared, got %v", got)
+	}
+}
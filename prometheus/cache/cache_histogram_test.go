@@ -0,0 +1,93 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import "testing"
+
+func TestUpdate_HistogramReusesBucketSlice(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_histogram", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	insert := func(counts ...uint64) Insert {
+		buckets := make([]BucketInsert, len(counts))
+		for i, cnt := range counts {
+			buckets[i] = BucketInsert{UpperBound: float64(i + 1), CumulativeCount: cnt}
+		}
+		return Insert{
+			Key:  key,
+			Help: "help",
+			Histogram: &HistogramInsert{
+				SampleCount: counts[len(counts)-1],
+				SampleSum:   1,
+				Buckets:     buckets,
+			},
+		}
+	}
+
+	if err := c.Update(false, []Insert{insert(1, 2, 3)}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+	m := c.metrics[key.hash()]
+	firstBucketSlice := m.Histogram.Bucket
+
+	if err := c.Update(false, []Insert{insert(2, 4, 6)}, nil); err != nil {
+		t.Fatalf("second Update: %v", err)
+	}
+	if got := m.Histogram.GetSampleCount(); got != 6 {
+		t.Errorf("got sample count %d, want 6", got)
+	}
+	if len(m.Histogram.Bucket) != 3 {
+		t.Fatalf("got %d buckets, want 3", len(m.Histogram.Bucket))
+	}
+	for i, b := range m.Histogram.Bucket {
+		if b != firstBucketSlice[i] {
+			t.Errorf("bucket %d was reallocated instead of reusing the *dto.Bucket from the first Update", i)
+		}
+	}
+	if m.Histogram.Bucket[2].GetCumulativeCount() != 6 {
+		t.Errorf("got last bucket count %d, want 6", m.Histogram.Bucket[2].GetCumulativeCount())
+	}
+}
+
+func TestUpdate_SummaryQuantiles(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_summary", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	insert := Insert{
+		Key:  key,
+		Help: "help",
+		Summary: &SummaryInsert{
+			SampleCount: 10,
+			SampleSum:   100,
+			Quantiles: []Quantile{
+				{Quantile: 0.99, Value: 9},
+				{Quantile: 0.5, Value: 5},
+			},
+		},
+	}
+	if err := c.Update(false, []Insert{insert}, nil); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	m := c.metrics[key.hash()]
+	if got := m.Summary.GetSampleCount(); got != 10 {
+		t.Errorf("got sample count %d, want 10", got)
+	}
+	if len(m.Summary.Quantile) != 2 {
+		t.Fatalf("got %d quantiles, want 2", len(m.Summary.Quantile))
+	}
+	if got := m.Summary.Quantile[0].GetQuantile(); got != 0.5 {
+		t.Errorf("quantiles not sorted: got first quantile %v, want 0.5", got)
+	}
+}
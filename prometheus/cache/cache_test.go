@@ -0,0 +1,151 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestUpdateFamilies_ReusesReinsertedMetrics(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	if err := c.Update(false, []Insert{{Key: key, Help: "help", ValueType: prometheus.CounterValue, Value: 1}}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+
+	hSum := key.hash()
+	before, ok := c.metrics[hSum]
+	if !ok {
+		t.Fatalf("metric %d not found in cache after initial Update", hSum)
+	}
+	beforeVersion := c.metricVersions[hSum]
+
+	if err := c.UpdateFamilies([]string{"foo_total"}, []Insert{{Key: key, Help: "help", ValueType: prometheus.CounterValue, Value: 2}}, nil); err != nil {
+		t.Fatalf("UpdateFamilies: %v", err)
+	}
+
+	after, ok := c.metrics[hSum]
+	if !ok {
+		t.Fatalf("metric %d missing from cache after UpdateFamilies", hSum)
+	}
+	if before != after {
+		t.Error("UpdateFamilies reallocated a metric that was re-inserted under the same key, defeating memory reuse")
+	}
+	if got := after.GetCounter().GetValue(); got != 2 {
+		t.Errorf("got counter value %v, want 2", got)
+	}
+
+	afterVersion := c.metricVersions[hSum]
+	if afterVersion.created != beforeVersion.created {
+		t.Errorf("metricVersion.created changed from %d to %d for a metric that was only refreshed, not newly added", beforeVersion.created, afterVersion.created)
+	}
+	if afterVersion.updated == beforeVersion.updated {
+		t.Error("metricVersion.updated did not advance after UpdateFamilies changed the metric's value")
+	}
+}
+
+func TestUpdateFamilies_DropsMetricsNotReinserted(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	keyA := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	keyB := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"2"}}
+	if err := c.Update(false, []Insert{
+		{Key: keyA, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+		{Key: keyB, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+	}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+
+	// A scoped refresh that only re-inserts keyA should drop keyB, exactly like
+	// Update(false, ...) with a matching deletion would.
+	if err := c.UpdateFamilies([]string{"foo_total"}, []Insert{
+		{Key: keyA, Help: "help", ValueType: prometheus.CounterValue, Value: 2},
+	}, nil); err != nil {
+		t.Fatalf("UpdateFamilies: %v", err)
+	}
+
+	if _, ok := c.metrics[keyA.hash()]; !ok {
+		t.Error("keyA missing from cache after UpdateFamilies re-inserted it")
+	}
+	if _, ok := c.metrics[keyB.hash()]; ok {
+		t.Error("keyB still present in cache after UpdateFamilies dropped it without re-inserting it")
+	}
+}
+
+func TestUpdateFamilies_LeavesOtherFamiliesUntouched(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	keptKey := Key{FQName: "bar_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	scopedKey := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	if err := c.Update(false, []Insert{
+		{Key: keptKey, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+		{Key: scopedKey, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+	}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+
+	before := c.metrics[keptKey.hash()]
+
+	if err := c.UpdateFamilies([]string{"foo_total"}, nil, nil); err != nil {
+		t.Fatalf("UpdateFamilies: %v", err)
+	}
+
+	if _, ok := c.metrics[scopedKey.hash()]; ok {
+		t.Error("scopedKey still present after UpdateFamilies dropped its family without re-inserting it")
+	}
+	after, ok := c.metrics[keptKey.hash()]
+	if !ok {
+		t.Fatal("keptKey was dropped by an UpdateFamilies call that did not scope its family")
+	}
+	if before != after {
+		t.Error("UpdateFamilies touched a metric outside the families it was scoped to")
+	}
+}
+
+func TestUpdateFamilies_DiffSinceDoesNotFlapReinsertedMetrics(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	if err := c.Update(false, []Insert{{Key: key, Help: "help", ValueType: prometheus.CounterValue, Value: 1}}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+
+	id, _, done := c.Snapshot()
+	done()
+
+	if err := c.UpdateFamilies([]string{"foo_total"}, []Insert{{Key: key, Help: "help", ValueType: prometheus.CounterValue, Value: 2}}, nil); err != nil {
+		t.Fatalf("UpdateFamilies: %v", err)
+	}
+
+	added, changed, removed, _, diffDone, err := c.DiffSince(id)
+	diffDone()
+	if err != nil {
+		t.Fatalf("DiffSince: %v", err)
+	}
+	if len(added) != 0 {
+		t.Errorf("got %d added metrics, want 0: a metric that was only refreshed must not be reported as added", len(added))
+	}
+	if len(removed) != 0 {
+		t.Errorf("got %d removed metrics, want 0: a metric that was only refreshed must not be reported as removed", len(removed))
+	}
+	if len(changed) != 1 {
+		t.Fatalf("got %d changed metrics, want 1", len(changed))
+	}
+	if got := changed[0].GetCounter().GetValue(); got != 2 {
+		t.Errorf("got changed counter value %v, want 2", got)
+	}
+}
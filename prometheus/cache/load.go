@@ -0,0 +1,156 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LoadFromExposition parses a Prometheus text or protobuf exposition payload read from r and
+// feeds every sample it contains into c via a single Update call, preserving HELP, TYPE, label
+// sets and timestamps. Exemplars survive for protobuf payloads, since expfmt.NewDecoder there
+// just unmarshals the wire format directly; the classic text format parsed for "text/plain"
+// payloads predates exemplars and carries none. OpenMetrics text is not supported: this
+// expfmt version has no OpenMetrics parser and falls back to the classic text decoder, which
+// errors out on OpenMetrics-only syntax (including exemplar comments) instead of reading it.
+//
+// contentType is the exposition's Content-Type header value; it determines whether r is parsed
+// as protobuf or text. This turns a CachedTGatherer into a drop-in aggregation point for sidecars
+// and proxies that scrape upstream endpoints on a slower cadence than their own scrape interval.
+func LoadFromExposition(c *CachedTGatherer, r io.Reader, contentType string, reset bool) error {
+	format := expfmt.ResponseFormat(http.Header{"Content-Type": []string{contentType}})
+	dec := expfmt.NewDecoder(r, format)
+
+	var inserts []Insert
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("cache: decoding exposition: %w", err)
+		}
+		inserts = append(inserts, insertsFromMetricFamily(&mf)...)
+	}
+	return c.Update(reset, inserts, nil)
+}
+
+// insertsFromMetricFamily translates every sample in mf into an Insert.
+func insertsFromMetricFamily(mf *dto.MetricFamily) []Insert {
+	inserts := make([]Insert, 0, len(mf.Metric))
+	for _, m := range mf.Metric {
+		in := Insert{
+			Key:       keyFromLabelPairs(mf.GetName(), m.Label),
+			Help:      mf.GetHelp(),
+			Timestamp: timeFromTimestampMs(m.TimestampMs),
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			in.ValueType = prometheus.CounterValue
+			in.Value = m.GetCounter().GetValue()
+			in.Exemplar = exemplarFromDTO(m.GetCounter().GetExemplar())
+		case dto.MetricType_GAUGE:
+			in.ValueType = prometheus.GaugeValue
+			in.Value = m.GetGauge().GetValue()
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			buckets := make([]BucketInsert, len(h.GetBucket()))
+			for i, b := range h.GetBucket() {
+				buckets[i] = BucketInsert{
+					UpperBound:      b.GetUpperBound(),
+					CumulativeCount: b.GetCumulativeCount(),
+					Exemplar:        exemplarFromDTO(b.GetExemplar()),
+				}
+			}
+			in.Histogram = &HistogramInsert{
+				SampleCount:                  h.GetSampleCount(),
+				SampleSum:                    h.GetSampleSum(),
+				Buckets:                      buckets,
+				NativeHistogramSchema:        h.Schema,
+				NativeHistogramZeroThreshold: h.ZeroThreshold,
+				NativeHistogramZeroCount:     h.ZeroCount,
+				NativeHistogramPositiveSpans: h.PositiveSpan,
+				NativeHistogramPositiveDelta: h.PositiveDelta,
+				NativeHistogramNegativeSpans: h.NegativeSpan,
+				NativeHistogramNegativeDelta: h.NegativeDelta,
+			}
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			quantiles := make([]Quantile, len(s.GetQuantile()))
+			for i, q := range s.GetQuantile() {
+				quantiles[i] = Quantile{Quantile: q.GetQuantile(), Value: q.GetValue()}
+			}
+			in.Summary = &SummaryInsert{
+				SampleCount: s.GetSampleCount(),
+				SampleSum:   s.GetSampleSum(),
+				Quantiles:   quantiles,
+			}
+		default:
+			in.ValueType = prometheus.UntypedValue
+			in.Value = m.GetUntyped().GetValue()
+		}
+
+		inserts = append(inserts, in)
+	}
+	return inserts
+}
+
+// keyFromLabelPairs builds a Key out of a decoded metric's label pairs.
+func keyFromLabelPairs(fqName string, labels []*dto.LabelPair) Key {
+	names := make([]string, len(labels))
+	values := make([]string, len(labels))
+	for i, lp := range labels {
+		names[i] = lp.GetName()
+		values[i] = lp.GetValue()
+	}
+	return Key{FQName: fqName, LabelNames: names, LabelValues: values}
+}
+
+// timeFromTimestampMs converts a dto.Metric's millisecond timestamp to a *time.Time, returning
+// nil if ms is nil.
+func timeFromTimestampMs(ms *int64) *time.Time {
+	if ms == nil {
+		return nil
+	}
+	t := time.UnixMilli(*ms)
+	return &t
+}
+
+// exemplarFromDTO converts a decoded exemplar to an *Exemplar, returning nil if e is nil.
+func exemplarFromDTO(e *dto.Exemplar) *Exemplar {
+	if e == nil {
+		return nil
+	}
+
+	labels := make(prometheus.Labels, len(e.Label))
+	for _, lp := range e.Label {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	ex := &Exemplar{Labels: labels, Value: e.GetValue()}
+	if e.Timestamp != nil {
+		t := e.Timestamp.AsTime()
+		ex.Timestamp = &t
+	}
+	return ex
+}
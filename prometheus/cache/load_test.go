@@ -0,0 +1,163 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLoadFromExposition_Text(t *testing.T) {
+	const body = `# HELP foo_total a counter
+# TYPE foo_total counter
+foo_total{a="1"} 1
+foo_total{a="2"} 2
+# HELP bar a gauge
+# TYPE bar gauge
+bar 3.5
+`
+	c := NewCachedTGatherer()
+	if err := LoadFromExposition(c, strings.NewReader(body), "text/plain; version=0.0.4", false); err != nil {
+		t.Fatalf("LoadFromExposition: %v", err)
+	}
+
+	mfs, done, err := c.Gather()
+	done()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(mfs) != 2 {
+		t.Fatalf("got %d metric families, want 2", len(mfs))
+	}
+
+	byName := map[string]int{}
+	for _, mf := range mfs {
+		byName[mf.GetName()] = len(mf.Metric)
+	}
+	if byName["foo_total"] != 2 {
+		t.Errorf("got %d foo_total metrics, want 2", byName["foo_total"])
+	}
+	if byName["bar"] != 1 {
+		t.Errorf("got %d bar metrics, want 1", byName["bar"])
+	}
+}
+
+func TestLoadFromExposition_Reset(t *testing.T) {
+	c := NewCachedTGatherer()
+	first := `# HELP foo_total a counter
+# TYPE foo_total counter
+foo_total{a="1"} 1
+`
+	if err := LoadFromExposition(c, strings.NewReader(first), "text/plain; version=0.0.4", false); err != nil {
+		t.Fatalf("first LoadFromExposition: %v", err)
+	}
+
+	second := `# HELP foo_total a counter
+# TYPE foo_total counter
+foo_total{a="2"} 1
+`
+	if err := LoadFromExposition(c, strings.NewReader(second), "text/plain; version=0.0.4", true); err != nil {
+		t.Fatalf("second LoadFromExposition: %v", err)
+	}
+
+	mfs, done, err := c.Gather()
+	done()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(mfs) != 1 || len(mfs[0].Metric) != 1 {
+		t.Fatalf("got %d metric families, want 1 with a single metric: %v", len(mfs), mfs)
+	}
+	if got := mfs[0].Metric[0].Label[0].GetValue(); got != "2" {
+		t.Errorf("got label value %q, want %q: reset=true should have dropped the first series", got, "2")
+	}
+}
+
+func TestLoadFromExposition_InvalidContentType(t *testing.T) {
+	c := NewCachedTGatherer()
+	if err := LoadFromExposition(c, strings.NewReader("not exposition data"), "application/json", false); err == nil {
+		t.Fatal("expected an error for an unparsable exposition payload, got nil")
+	}
+}
+
+// TestLoadFromExposition_ProtoPreservesExemplar pins down the one case where exemplars do
+// survive LoadFromExposition: protobuf payloads, since the decoder there unmarshals the wire
+// format (and its Exemplar fields) directly rather than re-parsing text.
+func TestLoadFromExposition_ProtoPreservesExemplar(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("foo_total"),
+		Help: proto.String("help"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("a"), Value: proto.String("1")}},
+			Counter: &dto.Counter{
+				Value: proto.Float64(1),
+				Exemplar: &dto.Exemplar{
+					Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+					Value: proto.Float64(1),
+				},
+			},
+		}},
+	}
+
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	buf := &bytes.Buffer{}
+	if err := expfmt.NewEncoder(buf, format).Encode(mf); err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+
+	c := NewCachedTGatherer()
+	if err := LoadFromExposition(c, buf, string(format), false); err != nil {
+		t.Fatalf("LoadFromExposition: %v", err)
+	}
+
+	mfs, done, err := c.Gather()
+	done()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(mfs) != 1 || len(mfs[0].Metric) != 1 {
+		t.Fatalf("got %d metric families, want 1 with a single metric: %v", len(mfs), mfs)
+	}
+	ex := mfs[0].Metric[0].GetCounter().GetExemplar()
+	if ex == nil {
+		t.Fatal("expected the exemplar to survive the protobuf round trip, got nil")
+	}
+	if got := ex.GetLabel()[0].GetValue(); got != "abc" {
+		t.Errorf("got exemplar label value %q, want %q", got, "abc")
+	}
+}
+
+// TestLoadFromExposition_OpenMetricsUnsupported documents a real limitation: this expfmt
+// version has no OpenMetrics parser, so an OpenMetrics text payload (the one exposition format
+// that actually carries exemplars in text form) is not silently misread, it errors out on the
+// OpenMetrics-only exemplar syntax instead.
+func TestLoadFromExposition_OpenMetricsUnsupported(t *testing.T) {
+	const body = `# HELP foo_total a counter
+# TYPE foo_total counter
+foo_total{a="1"} 1 # {trace_id="abc"} 1.0
+# EOF
+`
+	c := NewCachedTGatherer()
+	err := LoadFromExposition(c, strings.NewReader(body), string(expfmt.NewFormat(expfmt.TypeOpenMetrics)), false)
+	if err == nil {
+		t.Fatal("expected an error parsing OpenMetrics-only syntax with the classic text decoder, got nil")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// HTTPDoer is the subset of http.Client used by Pusher, so callers can plug in their own client
+// (e.g. to add auth, tracing, or a custom transport).
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// BackoffFunc returns how long to wait before retrying the attempt'th failed push (0-indexed).
+type BackoffFunc func(attempt int) time.Duration
+
+// Pusher pushes a CachedTGatherer's snapshot to a Prometheus Pushgateway. It encodes the
+// normalized snapshot returned by Gather into a buffer while holding the read lock, releases the
+// lock, and only then sends that buffer, so retries resend the same body without gathering again.
+type Pusher struct {
+	c *CachedTGatherer
+
+	url      string
+	job      string
+	grouping map[string]string
+
+	client  HTTPDoer
+	retries int
+	backoff BackoffFunc
+}
+
+// NewPusher returns a Pusher that pushes c's snapshot to the Pushgateway at url under job. url is
+// the Pushgateway's base URL, e.g. "http://example.org:9091".
+func NewPusher(c *CachedTGatherer, url, job string) *Pusher {
+	return &Pusher{
+		c:        c,
+		url:      strings.TrimRight(url, "/"),
+		job:      job,
+		grouping: map[string]string{},
+		client:   http.DefaultClient,
+	}
+}
+
+// Client sets the HTTPDoer used to perform the push, e.g. to attach auth headers or a custom
+// *http.Client. The default is http.DefaultClient.
+func (p *Pusher) Client(c HTTPDoer) *Pusher {
+	p.client = c
+	return p
+}
+
+// Grouping adds a grouping label to the Pushgateway URL. It panics if name or value contains a
+// "/", mirroring the restriction the Pushgateway itself enforces on grouping keys.
+func (p *Pusher) Grouping(name, value string) *Pusher {
+	if strings.Contains(name, "/") || strings.Contains(value, "/") {
+		panic(fmt.Sprintf("cache: grouping label %q=%q must not contain '/'", name, value))
+	}
+	p.grouping[name] = value
+	return p
+}
+
+// Backoff sets the retry count and the delay between retries for a failed push. The default is
+// no retries.
+func (p *Pusher) Backoff(retries int, backoff BackoffFunc) *Pusher {
+	p.retries = retries
+	p.backoff = backoff
+	return p
+}
+
+// Push pushes c's current snapshot to the Pushgateway, replacing any metrics previously pushed
+// for the same job/grouping (HTTP PUT semantics).
+func (p *Pusher) Push() error {
+	return p.do(http.MethodPut)
+}
+
+// Add pushes c's current snapshot to the Pushgateway, merging it with any metrics previously
+// pushed for the same job/grouping (HTTP POST semantics).
+func (p *Pusher) Add() error {
+	return p.do(http.MethodPost)
+}
+
+func (p *Pusher) do(method string) error {
+	mfs, done, err := p.c.Gather()
+	if err != nil {
+		done()
+		return fmt.Errorf("cache: gathering snapshot to push: %w", err)
+	}
+
+	buf := &bytes.Buffer{}
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	enc := expfmt.NewEncoder(buf, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			done()
+			return fmt.Errorf("cache: encoding snapshot to push: %w", err)
+		}
+	}
+	done()
+
+	var lastErr error
+	for attempt := 0; attempt <= p.retries; attempt++ {
+		if attempt > 0 && p.backoff != nil {
+			time.Sleep(p.backoff(attempt - 1))
+		}
+		if lastErr = p.push(method, string(format), buf.Bytes()); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func (p *Pusher) push(method, contentType string, body []byte) error {
+	req, err := http.NewRequest(method, p.pushURL(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cache: building push request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cache: pushing to %s: %w", p.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("cache: unexpected status %q pushing to %s: %s", resp.Status, p.url, b)
+	}
+	return nil
+}
+
+// pushURL builds the Pushgateway URL for this job and its grouping labels, e.g.
+// ".../metrics/job/<job>/<name>/<value>/...".
+func (p *Pusher) pushURL() string {
+	urlComponents := []string{url.PathEscape(p.job)}
+	for name, value := range p.grouping {
+		urlComponents = append(urlComponents, url.PathEscape(name), url.PathEscape(value))
+	}
+	return fmt.Sprintf("%s/metrics/job/%s", p.url, strings.Join(urlComponents, "/"))
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPusher_Push(t *testing.T) {
+	var gotMethod, gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewCachedTGatherer()
+	if err := c.Update(false, []Insert{{
+		Key:       Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}},
+		Help:      "help",
+		ValueType: prometheus.CounterValue,
+		Value:     1,
+	}}, nil); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	p := NewPusher(c, srv.URL, "myjob").Grouping("instance", "localhost")
+	if err := p.Push(); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if gotMethod != http.MethodPut {
+		t.Errorf("got method %q, want PUT", gotMethod)
+	}
+	wantPath := "/metrics/job/myjob/instance/localhost"
+	if gotPath != wantPath {
+		t.Errorf("got path %q, want %q", gotPath, wantPath)
+	}
+}
+
+func TestPusher_Add(t *testing.T) {
+	var gotMethod string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewCachedTGatherer()
+	p := NewPusher(c, srv.URL, "myjob")
+	if err := p.Add(); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if gotMethod != http.MethodPost {
+		t.Errorf("got method %q, want POST", gotMethod)
+	}
+}
+
+func TestPusher_PushRetriesOnFailure(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		io.Copy(io.Discard, r.Body)
+		if attempts < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewCachedTGatherer()
+	p := NewPusher(c, srv.URL, "myjob").Backoff(2, func(int) time.Duration { return 0 })
+	if err := p.Push(); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestPusher_PushFailsAfterExhaustingRetries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := NewCachedTGatherer()
+	p := NewPusher(c, srv.URL, "myjob").Backoff(1, func(int) time.Duration { return 0 })
+	if err := p.Push(); err == nil {
+		t.Fatal("expected an error once retries are exhausted, got nil")
+	}
+}
+
+func TestPusher_GroupingRejectsSlash(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Grouping to panic on a label containing '/'")
+		}
+	}()
+	NewPusher(NewCachedTGatherer(), "http://example.org", "myjob").Grouping("a/b", "c")
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus/internal"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxTrackedRemovals bounds the removals ring DiffSince can replay. Once a removal is evicted,
+// a DiffSince call for an id older than the eviction can no longer be answered exactly and fails
+// with ErrDiffTooOld.
+const maxTrackedRemovals = 4096
+
+// ErrDiffTooOld is returned by DiffSince when id predates what the bounded removal history can
+// still replay. Callers should fall back to Snapshot in that case.
+var ErrDiffTooOld = errors.New("cache: id predates the tracked removal history, take a fresh Snapshot")
+
+// metricVersion tracks, for a single cached metric, the cache version it was first inserted at
+// and the version it was last changed at.
+type metricVersion struct {
+	created uint64
+	updated uint64
+}
+
+// removedMetric is an entry in the bounded removals ring kept for DiffSince.
+type removedMetric struct {
+	key     Key
+	version uint64
+}
+
+// recordRemoval appends a removal to the bounded ring, evicting the oldest entry (and bumping
+// evictedUpToVersion) once the ring is full. Callers must hold mMu for writing.
+func (c *CachedTGatherer) recordRemoval(key Key, version uint64) {
+	if len(c.removals) >= maxTrackedRemovals {
+		c.evictedUpToVersion = c.removals[0].version
+		c.removals = c.removals[1:]
+	}
+	c.removals = append(c.removals, removedMetric{key: key, version: version})
+}
+
+// Snapshot is like Gather, but also returns the cache's current version. Pass id to a later
+// DiffSince call to compute the delta between this snapshot and a future one.
+func (c *CachedTGatherer) Snapshot() (id uint64, mfs []*dto.MetricFamily, done func()) {
+	c.mMu.RLock()
+
+	return c.version, internal.NormalizeMetricFamilies(c.metricFamilyByName), c.mMu.RUnlock
+}
+
+// DiffSince computes the exact delta between the cache's current state and the state at id, a
+// version previously returned by Snapshot or DiffSince. It returns ErrDiffTooOld if id predates
+// what the bounded removal history can still replay; callers should take a fresh Snapshot
+// instead. This lets consumers (remote-write bridges, cache-coherent HTTP handlers) serialize
+// only what changed since their previous scrape.
+func (c *CachedTGatherer) DiffSince(id uint64) (added, changed []*dto.Metric, removed []Key, newID uint64, done func(), err error) {
+	c.mMu.RLock()
+
+	if id > c.version {
+		c.mMu.RUnlock()
+		return nil, nil, nil, 0, nil, fmt.Errorf("cache: id %d is ahead of the current version %d", id, c.version)
+	}
+	if id < c.evictedUpToVersion {
+		c.mMu.RUnlock()
+		return nil, nil, nil, 0, nil, ErrDiffTooOld
+	}
+
+	for hSum, mv := range c.metricVersions {
+		if mv.updated <= id {
+			continue
+		}
+		m, ok := c.metrics[hSum]
+		if !ok {
+			continue
+		}
+		if mv.created > id {
+			added = append(added, m)
+		} else {
+			changed = append(changed, m)
+		}
+	}
+	for _, r := range c.removals {
+		if r.version > id {
+			removed = append(removed, r.key)
+		}
+	}
+
+	return added, changed, removed, c.version, c.mMu.RUnlock, nil
+}
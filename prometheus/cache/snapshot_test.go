@@ -0,0 +1,95 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDiffSince_AddedChangedRemoved(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	keyA := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	keyB := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"2"}}
+	if err := c.Update(false, []Insert{
+		{Key: keyA, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+		{Key: keyB, Help: "help", ValueType: prometheus.CounterValue, Value: 1},
+	}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+
+	id, _, done := c.Snapshot()
+	done()
+
+	keyC := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"3"}}
+	if err := c.Update(false, []Insert{
+		{Key: keyA, Help: "help", ValueType: prometheus.CounterValue, Value: 2}, // changed
+		{Key: keyC, Help: "help", ValueType: prometheus.CounterValue, Value: 1}, // added
+	}, []Key{keyB}); err != nil { // removed
+		t.Fatalf("second Update: %v", err)
+	}
+
+	added, changed, removed, newID, diffDone, err := c.DiffSince(id)
+	diffDone()
+	if err != nil {
+		t.Fatalf("DiffSince: %v", err)
+	}
+	if newID != c.version {
+		t.Errorf("got newID %d, want current version %d", newID, c.version)
+	}
+	if len(added) != 1 || added[0].GetCounter().GetValue() != 1 {
+		t.Errorf("got added %v, want a single metric with value 1", added)
+	}
+	if len(changed) != 1 || changed[0].GetCounter().GetValue() != 2 {
+		t.Errorf("got changed %v, want a single metric with value 2", changed)
+	}
+	if len(removed) != 1 || removed[0].hash() != keyB.hash() {
+		t.Errorf("got removed %v, want %v", removed, keyB)
+	}
+}
+
+func TestDiffSince_IDAheadOfCurrentVersion(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	_, _, _, _, _, err := c.DiffSince(1)
+	if err == nil {
+		t.Fatal("expected an error for an id ahead of the current version, got nil")
+	}
+}
+
+func TestDiffSince_ErrDiffTooOld(t *testing.T) {
+	c := NewCachedTGatherer()
+
+	key := Key{FQName: "foo_total", LabelNames: []string{"a"}, LabelValues: []string{"1"}}
+	if err := c.Update(false, []Insert{{Key: key, Help: "help", ValueType: prometheus.CounterValue, Value: 1}}, nil); err != nil {
+		t.Fatalf("initial Update: %v", err)
+	}
+	id, _, done := c.Snapshot()
+	done()
+
+	// Force the removal ring to evict id's snapshot by recording more removals than it can hold.
+	c.mMu.Lock()
+	for i := 0; i < maxTrackedRemovals+1; i++ {
+		c.recordRemoval(Key{FQName: "evict", LabelNames: nil, LabelValues: nil}, c.version+1)
+	}
+	c.mMu.Unlock()
+
+	_, _, _, _, _, err := c.DiffSince(id)
+	if !errors.Is(err, ErrDiffTooOld) {
+		t.Fatalf("got err %v, want ErrDiffTooOld", err)
+	}
+}